@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// errEntryNotFound is wrapped by a Backend's Get when key has no entry.
+var errEntryNotFound = errors.New("keep: no such cache entry")
+
+// Backend stores finished cache entries: metadata plus the stdout/stderr
+// blobs captured for them. Single-flight leader election (see
+// singleflight.go) always elects a local leader through a flock file first,
+// since coalescing processes on the same host doesn't need a backend at
+// all. A Backend that also implements DistributedLocker (redis does) is
+// then used to extend that coalescing across hosts sharing it; one that
+// doesn't (file, sqlite) only gets you a shared cache, not shared
+// single-flight — each host still races independently.
+type Backend interface {
+	// Get loads the stored entry for key. The returned error wraps
+	// errEntryNotFound if no entry exists.
+	Get(key string) (*commandState, error)
+	// Put commits a finished run. outTmp and errTmp are local scratch files
+	// captureOutput streamed the run's stdout/stderr to; Put takes
+	// ownership of them. errTmp only matters when state.HasErr is set. ttl
+	// is the entry's configured --ttl, for backends (redis) that can expire
+	// entries server-side instead of relying solely on IsExpired at read
+	// time; a zero ttl means no expiry.
+	Put(key string, state *commandState, outTmp, errTmp string, ttl time.Duration) error
+	// Open opens a stored blob ("out" or "err") for replay.
+	Open(key, fd string) (io.ReadCloser, error)
+	// List returns every stored entry.
+	List() ([]*commandState, error)
+	// Delete removes a stored entry and its blobs.
+	Delete(key string) error
+}
+
+// DistributedLocker is implemented by backends that can coordinate
+// single-flight leader election across hosts, not just within one (see
+// Backend). keep's local flock-based election still runs first on every
+// host; only the local leader needs to also go through DistributedLocker,
+// to find out whether some other host got there first.
+type DistributedLocker interface {
+	// TryAcquire attempts to become the distributed leader for key. While
+	// held, the lease is kept renewed in the background (so a long-running
+	// command doesn't lose it out from under itself) until release is
+	// called. ok is false, with a nil error, if another host already holds
+	// the lease.
+	TryAcquire(key string, lease time.Duration) (release func(), ok bool, err error)
+	// WaitUnlocked blocks until key's distributed lease is free, whether
+	// released or expired.
+	WaitUnlocked(key string) error
+}
+
+var backendFlag string
+
+func init() {
+	flags.StringVar(&backendFlag, "backend", "", "cache storage backend: file (default), sqlite:<path>, or redis://host:port")
+}
+
+// newBackend builds the configured Backend, storing local scratch files
+// (used regardless of backend for streaming capture and single-flight
+// tailing) under dir. --backend wins over $KEEP_BACKEND; with neither set,
+// entries live as files under dir, same as before backends existed.
+func newBackend(dir string) (Backend, error) {
+	spec := backendFlag
+	if spec == "" {
+		spec = os.Getenv("KEEP_BACKEND")
+	}
+
+	switch {
+	case spec == "" || spec == "file":
+		return newFilesystemBackend(dir)
+	case strings.HasPrefix(spec, "sqlite:"):
+		return newSQLiteBackend(strings.TrimPrefix(spec, "sqlite:"))
+	case strings.HasPrefix(spec, "redis://"):
+		return newRedisBackend(spec)
+	default:
+		return nil, fmt.Errorf("keep: unknown --backend %q", spec)
+	}
+}
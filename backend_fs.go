@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filesystemBackend is the original, zero-dependency layout: one state file
+// per key plus sibling ".blob"/".err" files, all under dir. It's the
+// default backend and what every other backend is benchmarked against.
+type filesystemBackend struct {
+	dir string
+}
+
+func newFilesystemBackend(dir string) (Backend, error) {
+	return &filesystemBackend{dir: dir}, nil
+}
+
+// errInvalidKey is returned when a key can't be trusted to stay inside dir
+// once joined into a path — e.g. one containing a path separator or "..".
+// Callers (see resolveEntry) are expected to filter these out themselves,
+// but the backend refuses them too rather than relying solely on that.
+var errInvalidKey = errors.New("keep: invalid cache key")
+
+func validKey(key string) bool {
+	return key != "" && filepath.Base(key) == key && key != "." && key != ".."
+}
+
+func (b *filesystemBackend) statePath(key string) string { return filepath.Join(b.dir, key) }
+func (b *filesystemBackend) outPath(key string) string   { return filepath.Join(b.dir, key+".blob") }
+func (b *filesystemBackend) errPath(key string) string   { return filepath.Join(b.dir, key+".err") }
+
+func (b *filesystemBackend) Get(key string) (*commandState, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+
+	data, err := os.ReadFile(b.statePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &commandState{key: key}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// Put ignores ttl: expiry for this backend is purely logical, enforced by
+// IsExpired at read time (see cmdPrune for the sweep that actually removes
+// expired files).
+func (b *filesystemBackend) Put(key string, state *commandState, outTmp, errTmp string, ttl time.Duration) error {
+	if !validKey(key) {
+		return fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(outTmp, b.outPath(key)); err != nil {
+		return err
+	}
+	if state.HasErr {
+		if err := os.Rename(errTmp, b.errPath(key)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(errTmp)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.statePath(key), data, 0600)
+}
+
+func (b *filesystemBackend) Open(key, fd string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+
+	switch fd {
+	case "out":
+		return os.Open(b.outPath(key))
+	case "err":
+		return os.Open(b.errPath(key))
+	default:
+		return nil, errUnknownFD(fd)
+	}
+}
+
+func (b *filesystemBackend) List() ([]*commandState, error) {
+	files, err := os.ReadDir(b.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*commandState
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasSuffix(name, ".blob") || strings.HasSuffix(name, ".err") ||
+			strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		state, err := b.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		// A lock file for a run that was never cached (e.g. a failure
+		// without --cache-failures) decodes as an empty, never-written state.
+		if state.Time.IsZero() {
+			continue
+		}
+		entries = append(entries, state)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+func (b *filesystemBackend) Delete(key string) error {
+	if !validKey(key) {
+		return fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+
+	for _, p := range []string{b.statePath(key), b.outPath(key), b.errPath(key)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
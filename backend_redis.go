@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBackend keeps entries in a shared Redis instance, for a cache that's
+// reused across machines (e.g. a CI fleet) rather than just one host. Put
+// sets each key's expiry to match --ttl, so stale entries age out of Redis
+// itself rather than just being skipped over by IsExpired, keeping the
+// shared instance from accumulating dead keys forever.
+//
+// redisBackend also implements DistributedLocker, so single-flight
+// coalescing extends across hosts sharing it: TryAcquire uses SET NX PX to
+// elect a leader, with a background renewal loop so a long-running command
+// doesn't lose its lease, and a check-and-delete script on release so a
+// lease we lost to expiry can't be stolen back from whoever acquired it
+// next. A follower on another host waits for the lease to clear (by
+// polling — keyspace notifications would avoid that, but need server-side
+// config we can't assume here), then checks the cache; if the leader's run
+// wasn't committed (e.g. an uncached failure), there's no cross-host
+// channel for its exit code the way the local lockInfo sidecar relays one
+// same-host, so the follower just runs the command itself rather than
+// guessing at one.
+type redisBackend struct {
+	client *redis.Client
+}
+
+func newRedisBackend(addr string) (Backend, error) {
+	opts, err := redis.ParseURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisBackend{client: redis.NewClient(opts)}, nil
+}
+
+func redisStateKey(key string) string { return "keep:" + key + ":state" }
+func redisOutKey(key string) string   { return "keep:" + key + ":out" }
+func redisErrKey(key string) string   { return "keep:" + key + ":err" }
+func redisLockKey(key string) string  { return "keep:" + key + ":lock" }
+
+// distributedPollInterval is how often WaitUnlocked re-checks the lock key.
+const distributedPollInterval = 200 * time.Millisecond
+
+// releaseLockScript deletes the lock key only if it still holds the token
+// the caller acquired it with, so releasing a lease we already lost to
+// expiry (and that's since been acquired by someone else) can't delete
+// their lock instead of ours.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewLease extends lockKey's TTL, retrying on a short backoff instead of
+// silently waiting out the rest of the tick interval on a transient error —
+// that wait is exactly the window another host's TryAcquire could slip into
+// if the lease actually expired out from under a still-running leader.
+func renewLease(ctx context.Context, client *redis.Client, lockKey string, lease time.Duration, stop <-chan struct{}) {
+	backoff := lease / 10
+	for {
+		if err := client.Expire(ctx, lockKey, lease).Err(); err == nil {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// TryAcquire elects a distributed leader for key via SET NX PX, renewing the
+// lease in the background until release is called.
+func (b *redisBackend) TryAcquire(key string, lease time.Duration) (release func(), ok bool, err error) {
+	ctx := context.Background()
+
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	acquired, err := b.client.SetNX(ctx, redisLockKey(key), token, lease).Result()
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				renewLease(ctx, b.client, redisLockKey(key), lease, stop)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(stop)
+			releaseLockScript.Run(ctx, b.client, []string{redisLockKey(key)}, token)
+		})
+	}
+	return release, true, nil
+}
+
+// WaitUnlocked blocks until key's distributed lease is free, whether
+// released or expired.
+func (b *redisBackend) WaitUnlocked(key string) error {
+	ctx := context.Background()
+	for {
+		held, err := b.client.Exists(ctx, redisLockKey(key)).Result()
+		if err != nil {
+			return err
+		}
+		if held == 0 {
+			return nil
+		}
+		time.Sleep(distributedPollInterval)
+	}
+}
+
+func (b *redisBackend) Get(key string) (*commandState, error) {
+	data, err := b.client.Get(context.Background(), redisStateKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &commandState{key: key}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (b *redisBackend) Put(key string, state *commandState, outTmp, errTmp string, ttl time.Duration) error {
+	defer os.Remove(outTmp)
+	defer os.Remove(errTmp)
+
+	outBlob, err := os.ReadFile(outTmp)
+	if err != nil {
+		return err
+	}
+
+	var errBlob []byte
+	if state.HasErr {
+		errBlob, err = os.ReadFile(errTmp)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	pipe := b.client.TxPipeline()
+	pipe.Set(ctx, redisStateKey(key), data, ttl)
+	pipe.Set(ctx, redisOutKey(key), outBlob, ttl)
+	if state.HasErr {
+		pipe.Set(ctx, redisErrKey(key), errBlob, ttl)
+	} else {
+		pipe.Del(ctx, redisErrKey(key))
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (b *redisBackend) Open(key, fd string) (io.ReadCloser, error) {
+	var rkey string
+	switch fd {
+	case "out":
+		rkey = redisOutKey(key)
+	case "err":
+		rkey = redisErrKey(key)
+	default:
+		return nil, errUnknownFD(fd)
+	}
+
+	data, err := b.client.Get(context.Background(), rkey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *redisBackend) List() ([]*commandState, error) {
+	ctx := context.Background()
+	var entries []*commandState
+
+	iter := b.client.Scan(ctx, 0, "keep:*:state", 0).Iterator()
+	for iter.Next(ctx) {
+		rkey := iter.Val()
+		key := rkey[len("keep:") : len(rkey)-len(":state")]
+
+		state, err := b.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if state.Time.IsZero() {
+			continue
+		}
+		entries = append(entries, state)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+func (b *redisBackend) Delete(key string) error {
+	ctx := context.Background()
+	return b.client.Del(ctx, redisStateKey(key), redisOutKey(key), redisErrKey(key)).Err()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBackend keeps every entry's metadata and blobs as rows in a single
+// sqlite file, so a cache can be shared by copying (or network-mounting)
+// one file instead of a whole directory tree.
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func newSQLiteBackend(path string) (Backend, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	const schema = `CREATE TABLE IF NOT EXISTS entries (
+		key      TEXT PRIMARY KEY,
+		state    TEXT NOT NULL,
+		out_blob BLOB,
+		err_blob BLOB
+	)`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteBackend{db: db}, nil
+}
+
+func (b *sqliteBackend) Get(key string) (*commandState, error) {
+	var data string
+	err := b.db.QueryRow(`SELECT state FROM entries WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &commandState{key: key}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Put ignores ttl: like the filesystem backend, expiry here is purely
+// logical (IsExpired at read time), not enforced by the store itself.
+func (b *sqliteBackend) Put(key string, state *commandState, outTmp, errTmp string, ttl time.Duration) error {
+	defer os.Remove(outTmp)
+	defer os.Remove(errTmp)
+
+	outBlob, err := os.ReadFile(outTmp)
+	if err != nil {
+		return err
+	}
+
+	var errBlob []byte
+	if state.HasErr {
+		errBlob, err = os.ReadFile(errTmp)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.db.Exec(
+		`INSERT INTO entries (key, state, out_blob, err_blob) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(key) DO UPDATE SET state = excluded.state, out_blob = excluded.out_blob, err_blob = excluded.err_blob`,
+		key, string(data), outBlob, errBlob)
+	return err
+}
+
+func (b *sqliteBackend) Open(key, fd string) (io.ReadCloser, error) {
+	var column string
+	switch fd {
+	case "out":
+		column = "out_blob"
+	case "err":
+		column = "err_blob"
+	default:
+		return nil, errUnknownFD(fd)
+	}
+
+	var data []byte
+	err := b.db.QueryRow(`SELECT `+column+` FROM entries WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *sqliteBackend) List() ([]*commandState, error) {
+	rows, err := b.db.Query(`SELECT key, state FROM entries ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*commandState
+	for rows.Next() {
+		var key, data string
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		state := &commandState{key: key}
+		if err := json.Unmarshal([]byte(data), state); err != nil {
+			return nil, err
+		}
+		if state.Time.IsZero() {
+			continue
+		}
+		entries = append(entries, state)
+	}
+	return entries, rows.Err()
+}
+
+func (b *sqliteBackend) Delete(key string) error {
+	_, err := b.db.Exec(`DELETE FROM entries WHERE key = ?`, key)
+	return err
+}
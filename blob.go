@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// captureResult is the outcome of streaming a command's output to local
+// scratch blob files: enough metadata for commandState to persist and later
+// replay it, plus the paths a Backend should Put.
+type captureResult struct {
+	Size      int64
+	SHA256    string
+	Chunks    []chunk
+	HasStderr bool
+}
+
+// blobWriter streams writes to a blob file while recording a chunk record
+// per write, so the order stdout and stderr were produced in can be
+// reconstructed on replay. Multiple blobWriters (one per fd) share a mutex
+// and chunk slice, since exec.Cmd copies stdout and stderr concurrently.
+type blobWriter struct {
+	fd   string
+	file *os.File
+
+	mu     *sync.Mutex
+	chunks *[]chunk
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	if n > 0 {
+		w.mu.Lock()
+		*w.chunks = append(*w.chunks, chunk{FD: w.fd, Len: int64(n)})
+		w.mu.Unlock()
+	}
+	return n, err
+}
+
+// captureOutput runs the command, tees its stdout/stderr to the terminal as
+// usual, and streams them to outTmp/errTmp (local scratch files, so a
+// single-flight follower can tail them live) as they're produced. On a
+// successful return, outTmp (and, if the result's HasStderr, errTmp) are
+// left in place for the caller to hand to a Backend's Put; the caller owns
+// cleaning them up afterward.
+func captureOutput(name string, args []string, outTmp, errTmp string, stdin io.Reader) (*captureResult, error) {
+	outFile, err := os.OpenFile(outTmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	errFile, err := os.OpenFile(errTmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		os.Remove(outTmp)
+		return nil, err
+	}
+	defer errFile.Close()
+
+	var mu sync.Mutex
+	var chunks []chunk
+	sum := sha256.New()
+	var size int64
+	var hasStderr bool
+
+	outW := &blobWriter{fd: "out", file: outFile, mu: &mu, chunks: &chunks}
+	errW := &blobWriter{fd: "err", file: errFile, mu: &mu, chunks: &chunks}
+	errMarker := &countingWriter{fn: func(p []byte) (int, error) { hasStderr = true; return len(p), nil }}
+	outHasher := &countingWriter{fn: func(p []byte) (int, error) {
+		n, err := sum.Write(p)
+		size += int64(n)
+		return n, err
+	}}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = io.MultiWriter(os.Stdout, outW, outHasher)
+	cmd.Stderr = io.MultiWriter(os.Stderr, errW, errMarker)
+	cmd.Stdin = stdin
+
+	// A non-zero exit still produces a result: the caller decides whether a
+	// failed run is worth caching, and needs the captured output either way.
+	runErr := cmd.Run()
+	var exitErr *exec.ExitError
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		os.Remove(outTmp)
+		os.Remove(errTmp)
+		return nil, runErr
+	}
+
+	if err := outFile.Sync(); err != nil {
+		os.Remove(outTmp)
+		os.Remove(errTmp)
+		return nil, err
+	}
+	if err := errFile.Sync(); err != nil {
+		os.Remove(outTmp)
+		os.Remove(errTmp)
+		return nil, err
+	}
+
+	result := &captureResult{
+		Size:      size,
+		SHA256:    hex.EncodeToString(sum.Sum(nil)),
+		Chunks:    chunks,
+		HasStderr: hasStderr,
+	}
+	return result, runErr
+}
+
+// countingWriter adapts a plain callback to io.Writer, for tapping a stream
+// without giving it a file to write to.
+type countingWriter struct {
+	fn func([]byte) (int, error)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	return w.fn(p)
+}
+
+// replayChunks replays a commandState's chunks in order, writing each one to
+// the writer matching its original fd ("out" chunks to stdout, "err" chunks
+// to stderr) so a cache hit reproduces the same stream separation a fresh
+// run would have. Blobs are opened lazily through backend and only as
+// needed; chunks for a given fd are always recorded in increasing-offset
+// order, so replay only ever reads each blob forward, never seeks.
+func replayChunks(backend Backend, key string, chunks []chunk, stdout, stderr io.Writer) error {
+	var outF, errF io.ReadCloser
+	defer func() {
+		if outF != nil {
+			outF.Close()
+		}
+		if errF != nil {
+			errF.Close()
+		}
+	}()
+
+	for _, c := range chunks {
+		var f io.ReadCloser
+		var w io.Writer
+		var err error
+
+		switch c.FD {
+		case "out":
+			if outF == nil {
+				if outF, err = backend.Open(key, "out"); err != nil {
+					return err
+				}
+			}
+			f, w = outF, stdout
+		case "err":
+			if errF == nil {
+				if errF, err = backend.Open(key, "err"); err != nil {
+					return err
+				}
+			}
+			f, w = errF, stderr
+		default:
+			return errUnknownFD(c.FD)
+		}
+
+		if _, err := io.CopyN(w, f, c.Len); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type errUnknownFD string
+
+func (e errUnknownFD) Error() string {
+	return "keep: unknown fd " + string(e)
+}
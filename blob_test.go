@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestCaptureAndReplaySeparatesStreams covers the replay path that a cache
+// hit takes: stdout chunks must land on stdout and stderr chunks on
+// stderr, not merged onto a single stream.
+func TestCaptureAndReplaySeparatesStreams(t *testing.T) {
+	dir := t.TempDir()
+	outTmp, errTmp := localScratchPaths(dir, "k")
+
+	result, err := captureOutput("sh", []string{"-c", "echo out1; echo err1 1>&2; echo out2"}, outTmp, errTmp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := &commandState{key: "k"}
+	state.SetResult(result)
+
+	backend, err := newFilesystemBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Put("k", state, outTmp, errTmp, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := backend.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := loaded.Replay(backend, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := stdout.String(), "out1\nout2\n"; got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "err1\n"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+}
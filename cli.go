@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// subcommands are the verbs `keep` reserves as its first positional
+// argument, ahead of the run-or-replay behavior. `keep -- ls` escapes this
+// and runs an `ls` binary instead.
+var subcommands = map[string]func(args []string) error{
+	"ls":      cmdLs,
+	"show":    cmdShow,
+	"rm":      cmdRm,
+	"prune":   cmdPrune,
+	"refresh": cmdRefresh,
+}
+
+// cmdLs lists every cached entry: command, age, TTL remaining, size, and
+// exit code.
+func cmdLs(args []string) error {
+	backend, err := currentBackend()
+	if err != nil {
+		return err
+	}
+
+	entries, err := backend.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCOMMAND\tAGE\tTTL\tSIZE\tEXIT")
+	for _, e := range entries {
+		age := time.Since(e.Time).Round(time.Second)
+		remaining := "expired"
+		if left := ttl - age; left > 0 {
+			remaining = left.String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", e.key, strings.Join(e.Cmd, " "), age, remaining, e.Size, e.ExitCode)
+	}
+	return w.Flush()
+}
+
+// cmdShow dumps a cached entry's replayed output.
+func cmdShow(args []string) error {
+	backend, err := currentBackend()
+	if err != nil {
+		return err
+	}
+
+	state, err := resolveEntry(backend, args)
+	if err != nil {
+		return err
+	}
+
+	return state.Replay(backend, os.Stdout, os.Stderr)
+}
+
+// cmdRm invalidates a single cached entry.
+func cmdRm(args []string) error {
+	backend, err := currentBackend()
+	if err != nil {
+		return err
+	}
+
+	state, err := resolveEntry(backend, args)
+	if err != nil {
+		return err
+	}
+	return removeEntry(backend, state)
+}
+
+// cmdPrune sweeps every entry older than --ttl, plus any local lock/flock
+// sidecars of the same age that a run left behind without ever committing a
+// cache entry (e.g. a failure without --cache-failures) — those are
+// invisible to backend.List, so they'd otherwise never be cleaned up.
+func cmdPrune(args []string) error {
+	backend, err := currentBackend()
+	if err != nil {
+		return err
+	}
+
+	entries, err := backend.List()
+	if err != nil {
+		return err
+	}
+
+	pruned := 0
+	for _, e := range entries {
+		if !e.IsExpired(ttl) {
+			continue
+		}
+		if err := removeEntry(backend, e); err != nil {
+			return err
+		}
+		pruned++
+	}
+
+	dir, err := keepDir()
+	if err != nil {
+		return err
+	}
+	stale, err := pruneStaleLockFiles(dir, ttl)
+	if err != nil {
+		return err
+	}
+	pruned += stale
+
+	noun := "entries"
+	if pruned == 1 {
+		noun = "entry"
+	}
+	fmt.Fprintf(os.Stdout, "pruned %d %s\n", pruned, noun)
+	return nil
+}
+
+// pruneStaleLockFiles removes any local ".lock"/".flock" sidecar older than
+// ttl, judged by mtime. These are left behind by runs that finished without
+// committing a cache entry, so backend.List never sees them; sweeping by
+// age here is the only way they're ever reclaimed.
+func pruneStaleLockFiles(dir string, ttl time.Duration) (int, error) {
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".lock") && !strings.HasSuffix(name, ".flock") {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) < ttl {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// cmdRefresh force-runs a command and overwrites its cache entry, ignoring
+// the current TTL.
+func cmdRefresh(args []string) error {
+	if len(args) == 0 {
+		return errors.New("refresh: need a command")
+	}
+	return keep(args, ttl, true)
+}
+
+// currentBackend builds the Backend the run-time flags/env select, rooted
+// at the usual local cache directory.
+func currentBackend() (Backend, error) {
+	dir, err := keepDir()
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(dir)
+}
+
+// resolveEntry finds the cached entry for a selector, which is either an
+// exact cache key or the command that would hash to one. A selector is only
+// tried as a literal key when it has the shape buildKey actually produces;
+// anything else falls through to being hashed as a command, so a selector
+// like "../../etc/passwd" can't be used to make a Backend address a path
+// outside the cache directory.
+func resolveEntry(backend Backend, selector []string) (*commandState, error) {
+	if len(selector) == 0 {
+		return nil, errors.New("need a key or command")
+	}
+
+	if len(selector) == 1 && looksLikeKey(selector[0]) {
+		if state, err := backend.Get(selector[0]); err == nil {
+			return state, nil
+		}
+	}
+
+	key, _, _, err := buildKey(selector, keyOptionsFromFlags(), os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	state, err := backend.Get(key)
+	if errors.Is(err, errEntryNotFound) {
+		return nil, fmt.Errorf("no cache entry for %q", strings.Join(selector, " "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// removeEntry deletes a cached entry and its sidecar lock files (left
+// behind by a run that finished without being cached).
+func removeEntry(backend Backend, s *commandState) error {
+	if err := backend.Delete(s.key); err != nil {
+		return err
+	}
+
+	dir, err := keepDir()
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{localLockInfoPath(dir, s.key), localFlockPath(dir, s.key)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResolveEntryRejectsPathTraversal covers the selector fast path: a
+// single-token selector shaped like a path (rather than a generated cache
+// key) must never be handed to the backend as a literal key, or it could
+// make a Backend address a file outside the cache directory.
+func TestResolveEntryRejectsPathTraversal(t *testing.T) {
+	cacheDir := t.TempDir()
+	backend, err := newFilesystemBackend(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file living next to (not inside) the cache directory, forming the
+	// "../<sibling>" selector a malicious or mistaken caller might pass.
+	victimDir := t.TempDir()
+	victim := filepath.Join(victimDir, "secret")
+	if err := os.WriteFile(victim, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	selector := []string{filepath.Join("..", filepath.Base(victimDir), "secret")}
+	if _, err := resolveEntry(backend, selector); err == nil {
+		t.Fatal("resolveEntry: got nil error for a path-shaped selector, want it rejected")
+	}
+
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("victim file should be untouched: %v", err)
+	}
+}
+
+// TestResolveEntryAcceptsLiteralKey covers the intended fast path: an exact,
+// correctly-shaped cache key still resolves directly without being
+// re-hashed as a command.
+func TestResolveEntryAcceptsLiteralKey(t *testing.T) {
+	cacheDir := t.TempDir()
+	backend, err := newFilesystemBackend(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, _, err := buildKey([]string{"echo", "hi"}, keyOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &commandState{key: key}
+	state.SetResult(&captureResult{})
+	outTmp, errTmp := localScratchPaths(cacheDir, key)
+	if err := os.WriteFile(outTmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(errTmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Put(key, state, outTmp, errTmp, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveEntry(backend, []string{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.key != key {
+		t.Errorf("resolveEntry returned entry for key %q, want %q", got.key, key)
+	}
+}
+
+// TestLooksLikeKey covers the shape check resolveEntry relies on to decide
+// whether a selector is safe to try as a literal backend key.
+func TestLooksLikeKey(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"v2-echo_abc123", true},
+		{"v1-echo_abc123", false},
+		{"../../etc/passwd", false},
+		{"v2-../escape", false},
+		{"v2-echo" + string([]byte{'\\'}) + "x", false},
+		{"echo hello", false},
+	}
+
+	for _, tt := range tests {
+		if got := looksLikeKey(tt.selector); got != tt.want {
+			t.Errorf("looksLikeKey(%q) = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// keyVersion is bumped whenever the key schema changes, so that entries
+// written under an older scheme are naturally invalidated: they simply
+// live under a differently-prefixed filename and are never looked up again.
+const keyVersion = "v2"
+
+// looksLikeKey reports whether s has the shape buildKey produces: the
+// current key version prefix and no path separators. resolveEntry uses this
+// to decide whether a selector is worth trying as a literal backend key at
+// all, so an arbitrary string (e.g. a path) is never handed to a Backend as
+// one.
+func looksLikeKey(s string) bool {
+	return strings.HasPrefix(s, keyVersion+"-") && !strings.ContainsAny(s, "/\\")
+}
+
+// keyComponent records one input that was folded into a cache key, for
+// `keep --explain-key` to print back for debugging.
+type keyComponent struct {
+	Kind string `json:"kind"` // "arg", "env", "stdin", or "file"
+	Name string `json:"name,omitempty"`
+	Sum  string `json:"sum"` // sha256 of this component's contribution
+}
+
+// keyOptions selects which extra inputs, beyond argv, are mixed into the
+// cache key.
+type keyOptions struct {
+	EnvKeys []string
+	Stdin   bool
+	Files   []string
+}
+
+// buildKey computes a cache key for command, folding in any extra inputs
+// requested by opts. If opts.Stdin is set, stdin is read to completion and
+// the returned reader replays it for the child process; otherwise stdin is
+// returned unchanged.
+func buildKey(command []string, opts keyOptions, stdin io.Reader) (key string, components []keyComponent, childStdin io.Reader, err error) {
+	h := sha256.New()
+	childStdin = stdin
+
+	add := func(kind, name string, data []byte) {
+		sum := sha256.Sum256(data)
+		components = append(components, keyComponent{Kind: kind, Name: name, Sum: hex.EncodeToString(sum[:])})
+		h.Write(sum[:])
+	}
+
+	for _, arg := range command[1:] {
+		add("arg", "", []byte(arg))
+	}
+
+	for _, name := range opts.EnvKeys {
+		add("env", name, []byte(os.Getenv(name)))
+	}
+
+	if opts.Stdin {
+		buf, readErr := io.ReadAll(stdin)
+		if readErr != nil {
+			return "", nil, nil, readErr
+		}
+		add("stdin", "", buf)
+		childStdin = bytes.NewReader(buf)
+	}
+
+	for _, path := range opts.Files {
+		data, statSum, readErr := fileKeyInput(path)
+		if readErr != nil {
+			return "", nil, nil, readErr
+		}
+		add("file", path, append(statSum, data...))
+	}
+
+	sum := h.Sum(nil)
+	key = keyVersion + "-" + command[0] + "_" + base64.RawURLEncoding.EncodeToString(sum)
+	return key, components, childStdin, nil
+}
+
+// fileKeyInput reads a file's contents and returns them alongside a short
+// header describing its mtime and size, so a touched-but-unchanged file
+// still busts the cache the way `make`/`bazel` input hashing would expect.
+func fileKeyInput(path string) (data []byte, header []byte, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	header = []byte(path + ":" + info.ModTime().UTC().String() + ":" + strconv.FormatInt(info.Size(), 10))
+	return data, header, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestBuildKeyDeterministicAndSensitiveToInputs covers the ordering and
+// composition buildKey promises: the same command and options always hash
+// to the same key, and each kind of extra input actually changes it.
+func TestBuildKeyDeterministicAndSensitiveToInputs(t *testing.T) {
+	base := []string{"echo", "hello"}
+
+	key1, components, _, err := buildKey(base, keyOptions{}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _, _, err := buildKey(base, keyOptions{}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 != key2 {
+		t.Errorf("buildKey is not deterministic: %q != %q", key1, key2)
+	}
+	if !strings.HasPrefix(key1, keyVersion+"-echo_") {
+		t.Errorf("key %q does not have the expected shape", key1)
+	}
+	if len(components) != 1 || components[0].Kind != "arg" {
+		t.Errorf("components = %+v, want a single \"arg\" component", components)
+	}
+
+	diffArgs, _, _, err := buildKey([]string{"echo", "goodbye"}, keyOptions{}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffArgs == key1 {
+		t.Error("changing an arg did not change the key")
+	}
+
+	t.Setenv("KEEP_TEST_KEY_ENV", "a")
+	withEnvA, _, _, err := buildKey(base, keyOptions{EnvKeys: []string{"KEEP_TEST_KEY_ENV"}}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KEEP_TEST_KEY_ENV", "b")
+	withEnvB, _, _, err := buildKey(base, keyOptions{EnvKeys: []string{"KEEP_TEST_KEY_ENV"}}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withEnvA == key1 || withEnvA == withEnvB {
+		t.Error("--key-env input is not being mixed into the key")
+	}
+
+	stdinA, components, childStdin, err := buildKey(base, keyOptions{Stdin: true}, strings.NewReader("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdinB, _, _, err := buildKey(base, keyOptions{Stdin: true}, strings.NewReader("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdinA == key1 || stdinA == stdinB {
+		t.Error("--key-stdin input is not being mixed into the key")
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(childStdin); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "one" {
+		t.Errorf("childStdin replay = %q, want %q", buf.String(), "one")
+	}
+	if len(components) != 2 || components[1].Kind != "stdin" {
+		t.Errorf("components = %+v, want a trailing \"stdin\" component", components)
+	}
+
+	file := t.TempDir() + "/input"
+	if err := os.WriteFile(file, []byte("contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	withFile, _, _, err := buildKey(base, keyOptions{Files: []string{file}}, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withFile == key1 {
+		t.Error("--key-file input is not being mixed into the key")
+	}
+}
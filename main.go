@@ -1,32 +1,40 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	flag "github.com/spf13/pflag"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
-	"unicode/utf8"
 )
 
+// distributedLeaseTTL is how long a DistributedLocker lease is held for
+// before it must be renewed; see Backend.
+const distributedLeaseTTL = 30 * time.Second
+
 var (
-	flags *flag.FlagSet
+	// flags is initialized here, rather than in init(), so that other
+	// files' init() functions can register flags on it regardless of
+	// which order the compiler processes the package's files in.
+	flags = flag.NewFlagSet("keep", flag.ContinueOnError)
 
-	ttl  time.Duration
-	help bool
+	ttl            time.Duration
+	help           bool
+	cacheFailures  bool
+	cacheExitCodes string
+	keyEnv         string
+	keyStdin       bool
+	keyFile        string
+	explainKey     bool
 )
 
 func init() {
-	flags = flag.NewFlagSet("keep", flag.ContinueOnError)
 	flags.SortFlags = false
 	flags.Usage = func() {
 		_, _ = fmt.Fprint(os.Stderr,
@@ -38,9 +46,54 @@ func init() {
 	flags.SetOutput(os.Stderr)
 
 	flags.DurationVar(&ttl, "ttl", 12*time.Hour, "time to remember command output")
+	flags.BoolVar(&cacheFailures, "cache-failures", false, "cache commands that exit non-zero, not just ones that succeed")
+	flags.StringVar(&cacheExitCodes, "cache-exit-codes", "", "comma-separated exit codes to cache in addition to 0, e.g. 0,1")
+	flags.StringVar(&keyEnv, "key-env", "", "comma-separated env var names to mix into the cache key")
+	flags.BoolVar(&keyStdin, "key-stdin", false, "mix stdin into the cache key (reads stdin fully before running)")
+	flags.StringVar(&keyFile, "key-file", "", "comma-separated file paths whose mtime and contents are mixed into the cache key")
+	flags.BoolVar(&explainKey, "explain-key", false, "print the cache key's component breakdown instead of running the command")
 	flags.BoolVarP(&help, "help", "h", false, "display this help message")
 }
 
+// shouldCacheExitCode reports whether a command that exited with code should
+// have its output cached. 0 is always cached; anything else requires
+// --cache-failures or an explicit --cache-exit-codes entry.
+func shouldCacheExitCode(code int) bool {
+	if code == 0 || cacheFailures {
+		return true
+	}
+	for _, s := range splitCSV(cacheExitCodes) {
+		if n, err := strconv.Atoi(s); err == nil && n == code {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCSV splits a comma-separated flag value into its trimmed,
+// non-empty parts.
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func keyOptionsFromFlags() keyOptions {
+	return keyOptions{
+		EnvKeys: splitCSV(keyEnv),
+		Stdin:   keyStdin,
+		Files:   splitCSV(keyFile),
+	}
+}
+
 func main() {
 	err := run()
 	if err != nil {
@@ -60,64 +113,222 @@ func run() error {
 		return nil
 	}
 
-	if len(flags.Args()) == 0 {
+	args := flags.Args()
+	if len(args) == 0 {
 		return errors.New("no command to run")
 	}
 
-	return keep(flags.Args(), ttl)
+	// "--" escapes subcommand dispatch, so `keep -- ls` runs the ls binary
+	// rather than the `keep ls` cache-inspection subcommand.
+	if flags.ArgsLenAtDash() != 0 {
+		if sub, ok := subcommands[args[0]]; ok {
+			return sub(args[1:])
+		}
+	}
+
+	if explainKey {
+		return explainKeyForCommand(args)
+	}
+
+	return keep(args, ttl, false)
 }
 
-func keep(command []string, ttl time.Duration) (err error) {
-	state := &commandState{Cmd: command}
+// explainKeyForCommand prints the cache key and its component breakdown for
+// a command without running it, for `keep --explain-key`.
+func explainKeyForCommand(command []string) error {
+	key, components, _, err := buildKey(command, keyOptionsFromFlags(), os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Key        string         `json:"key"`
+		KeyVersion string         `json:"key_version"`
+		Inputs     []keyComponent `json:"inputs"`
+	}{Key: key, KeyVersion: keyVersion, Inputs: components})
+}
 
-	stateFile, err := openStateFile(state.Key())
+// keep runs command and caches its output, unless a fresh cache entry
+// already exists. force skips the freshness check and always re-runs,
+// for `keep refresh`.
+func keep(command []string, ttl time.Duration, force bool) (err error) {
+	dir, err := keepDir()
 	if err != nil {
 		return err
 	}
-	defer doCloseStateFile(stateFile, &err)
 
-	err = readState(stateFile, state)
+	backend, err := newBackend(dir)
 	if err != nil {
 		return err
 	}
 
-	if !state.IsExpired(ttl) {
-		_, err = io.Copy(os.Stdout, state.Output())
-		if err != nil {
+	key, components, childStdin, err := buildKey(command, keyOptionsFromFlags(), os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	// Single-flight leader election always happens on a local rendezvous
+	// file, regardless of backend: coalescing concurrent invocations is a
+	// same-host concern, independent of where the finished result lives.
+	lockFile, err := openLockFile(dir, key)
+	if err != nil {
+		return err
+	}
+	defer doCloseLockFile(lockFile, &err)
+
+	leader, err := tryLockExclusive(lockFile)
+	if err != nil {
+		return err
+	}
+	if !leader {
+		return followRun(lockFile, backend, dir, key)
+	}
+
+	state, getErr := backend.Get(key)
+	if getErr != nil && !errors.Is(getErr, errEntryNotFound) {
+		return getErr
+	}
+	if state == nil {
+		state = &commandState{key: key}
+	}
+	state.Cmd = command
+	// Exported fields above may have just been overwritten by a stale cache
+	// entry; the key and its components always reflect this invocation.
+	state.KeyVersion = keyVersion
+	state.KeyInputs = components
+
+	if !force && getErr == nil && !state.IsExpired(ttl) {
+		if err := state.Replay(backend, os.Stdout, os.Stderr); err != nil {
 			return err
 		}
+		if state.ExitCode != 0 {
+			os.Exit(state.ExitCode)
+		}
 		return nil
 	}
 
-	out, err := captureOutput(command[0], command[1:])
+	// Being the local leader only coalesces with other processes on this
+	// host. If backend can coordinate across hosts too, make sure we're the
+	// leader there as well before running the command ourselves.
+	//
+	// release is called explicitly ahead of every os.Exit below, in
+	// addition to the defer: os.Exit skips deferred calls entirely, and
+	// without an explicit release a held Redis lease would otherwise sit
+	// around for the rest of distributedLeaseTTL after we're already done,
+	// needlessly stalling any follower on another host. release is
+	// idempotent, so calling it twice (here and via the defer, on whichever
+	// return path doesn't os.Exit) is harmless.
+	release := func() {}
+	defer func() { release() }()
+	if locker, ok := backend.(DistributedLocker); ok {
+		acquiredRelease, acquired, lockErr := locker.TryAcquire(key, distributedLeaseTTL)
+		if lockErr != nil {
+			return lockErr
+		}
+		if acquired {
+			release = acquiredRelease
+		} else {
+			if err := locker.WaitUnlocked(key); err != nil {
+				return err
+			}
+			if !force {
+				if state, getErr := backend.Get(key); getErr == nil && !state.IsExpired(ttl) {
+					if err := state.Replay(backend, os.Stdout, os.Stderr); err != nil {
+						return err
+					}
+					if state.ExitCode != 0 {
+						os.Exit(state.ExitCode)
+					}
+					return nil
+				}
+			}
+			// The remote leader's run finished but wasn't committed (e.g. an
+			// uncached failure). There's no cross-host channel for its exit
+			// code the way the local lockInfo sidecar relays one same-host,
+			// so run the command ourselves rather than guessing at one.
+		}
+	}
+
+	lockPath := localLockInfoPath(dir, key)
+	_ = writeLockFile(lockPath, lockInfo{PID: os.Getpid()})
+
+	outTmp, errTmp := localScratchPaths(dir, key)
+	result, runErr := captureOutput(command[0], command[1:], outTmp, errTmp, childStdin)
 	var exitErr *exec.ExitError
-	if errors.As(err, &exitErr) {
-		os.Exit(exitErr.ExitCode())
+	if runErr != nil && !errors.As(runErr, &exitErr) {
+		_ = os.Remove(lockPath)
+		return runErr
 	}
-	if err != nil {
-		return err
+
+	exitCode := 0
+	if exitErr != nil {
+		exitCode = exitErr.ExitCode()
+	}
+	// Followers tailing our output only have the sidecar lock file to learn
+	// our exit code from if we end up not writing a cache entry below, so it
+	// must still be there when they read it after we exit.
+	_ = writeLockFile(lockPath, lockInfo{PID: os.Getpid(), ExitCode: &exitCode})
+
+	if !shouldCacheExitCode(exitCode) {
+		os.Remove(outTmp)
+		os.Remove(errTmp)
+		release()
+		os.Exit(exitCode)
 	}
 
-	state.SetOutput(out)
+	state.ExitCode = exitCode
+	state.SetResult(result)
 
-	err = writeState(stateFile, state)
+	err = backend.Put(key, state, outTmp, errTmp, ttl)
+	_ = os.Remove(lockPath)
 	if err != nil {
 		return err
 	}
 
+	if exitCode != 0 {
+		release()
+		os.Exit(exitCode)
+	}
+
 	return nil
 }
 
-func openStateFile(key string) (*os.File, error) {
+func keepDir() (string, error) {
 	stateHome, err := xdgStateHomeDir()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return filepath.Join(stateHome, "keep"), nil
+}
+
+// localScratchPaths are the local files captureOutput streams a running
+// command's stdout/stderr to, regardless of which Backend ends up storing
+// the finished result.
+func localScratchPaths(dir, key string) (outTmp, errTmp string) {
+	return filepath.Join(dir, key+".out.tmp"), filepath.Join(dir, key+".err.tmp")
+}
 
-	name := filepath.Join(stateHome, "keep", key)
+// localLockInfoPath is the sidecar file a leader advertises its run (and,
+// once known, its exit code) through, for followers coalescing onto it.
+func localLockInfoPath(dir, key string) string {
+	return filepath.Join(dir, key+".lock")
+}
+
+// localFlockPath is the local rendezvous file single-flight leader election
+// flocks.
+func localFlockPath(dir, key string) string {
+	return filepath.Join(dir, key+".flock")
+}
+
+// openLockFile opens (creating if needed) the local rendezvous file callers
+// flock for single-flight leader election, without locking it itself.
+func openLockFile(dir, key string) (*os.File, error) {
+	name := localFlockPath(dir, key)
 	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
 	if errors.Is(err, os.ErrNotExist) {
-		err = os.Mkdir(filepath.Dir(name), 0700)
+		err = os.MkdirAll(dir, 0700)
 		if err != nil {
 			return nil, err
 		}
@@ -127,16 +338,10 @@ func openStateFile(key string) (*os.File, error) {
 		return nil, err
 	}
 
-	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
-	if err != nil {
-		_ = file.Close()
-		return nil, err
-	}
-
 	return file, nil
 }
 
-func doCloseStateFile(file *os.File, err *error) {
+func doCloseLockFile(file *os.File, err *error) {
 	unlockErr := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
 	if unlockErr != nil && *err == nil {
 		*err = unlockErr
@@ -147,50 +352,6 @@ func doCloseStateFile(file *os.File, err *error) {
 	}
 }
 
-func readState(file *os.File, state *commandState) (err error) {
-	dec := json.NewDecoder(file)
-	err = dec.Decode(&state)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
-	}
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func writeState(file *os.File, state *commandState) (err error) {
-	err = file.Truncate(0)
-	if err != nil {
-		return err
-	}
-	enc := json.NewEncoder(file)
-	enc.SetEscapeHTML(false)
-	err = enc.Encode(state)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func captureOutput(name string, args []string) ([]byte, error) {
-	var buf bytes.Buffer
-
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = io.MultiWriter(&buf, os.Stdout)
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	err := cmd.Run()
-	if err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
-}
-
 func xdgStateHomeDir() (string, error) {
 	dir := os.Getenv("XDG_STATE_HOME")
 	if dir != "" {
@@ -202,39 +363,3 @@ func xdgStateHomeDir() (string, error) {
 	}
 	return filepath.Join(homeDir, ".local", "state"), nil
 }
-
-type commandState struct {
-	Cmd       []string  `json:"cmd"`
-	Time      time.Time `json:"time"`
-	OutFormat string    `json:"outfmt,omitempty"`
-	Out       string    `json:"out,omitempty"`
-}
-
-func (s *commandState) Key() string {
-	argsSum := sha1.Sum([]byte(strings.Join(s.Cmd[1:], "\t")))
-	return s.Cmd[0] + "_" + base64.RawURLEncoding.EncodeToString(argsSum[:])
-}
-
-func (s *commandState) IsExpired(ttl time.Duration) bool {
-	return time.Now().After(s.Time.Add(ttl))
-}
-
-func (s *commandState) SetOutput(buf []byte) {
-	s.Time = time.Now()
-	if utf8.Valid(buf) {
-		s.Out = string(buf)
-	} else {
-		s.OutFormat = "base64"
-		s.Out = base64.StdEncoding.EncodeToString(buf)
-	}
-}
-
-func (s *commandState) Output() io.Reader {
-	var out io.Reader = strings.NewReader(s.Out)
-	switch s.OutFormat {
-	case "base64":
-		return base64.NewDecoder(base64.StdEncoding, out)
-	default:
-		return out
-	}
-}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// TestShouldCacheExitCode covers the precedence between the always-cached
+// zero exit, --cache-failures, and --cache-exit-codes.
+func TestShouldCacheExitCode(t *testing.T) {
+	defer func(failures bool, codes string) {
+		cacheFailures = failures
+		cacheExitCodes = codes
+	}(cacheFailures, cacheExitCodes)
+
+	tests := []struct {
+		name          string
+		cacheFailures bool
+		exitCodes     string
+		code          int
+		want          bool
+	}{
+		{"zero always cached", false, "", 0, true},
+		{"non-zero not cached by default", false, "", 1, false},
+		{"cache-failures caches any code", true, "", 17, true},
+		{"explicit code is cached", false, "2,3", 3, true},
+		{"other codes still rejected", false, "2,3", 4, false},
+		{"zero cached even with explicit codes set", false, "2,3", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheFailures = tt.cacheFailures
+			cacheExitCodes = tt.exitCodes
+			if got := shouldCacheExitCode(tt.code); got != tt.want {
+				t.Errorf("shouldCacheExitCode(%d) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
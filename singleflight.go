@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockInfo is the sidecar `<key>.lock` file a leader writes while it runs, so
+// followers have something to read the exit code from even for a run that
+// ends up not being cached.
+type lockInfo struct {
+	PID      int  `json:"pid"`
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+func writeLockFile(path string, info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func readLockFile(path string) (*lockInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var info lockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// tryLockExclusive attempts to become the leader for a key without
+// blocking. ok is false, with a nil error, if another process already
+// holds the lock.
+func tryLockExclusive(file *os.File) (ok bool, err error) {
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return false, err
+}
+
+// followRun coalesces onto another process's in-progress run of the same
+// command: it tails the leader's local scratch output as the leader writes
+// it, then waits for the leader to release its lock before replaying the
+// committed result (or, for a run that ends up uncached, the leader's
+// recorded exit code) and exiting with the same code the leader did.
+func followRun(lockFile *os.File, backend Backend, dir, key string) (err error) {
+	outTmp, errTmp := localScratchPaths(dir, key)
+
+	var outOff, errOff int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			outOff = tailFile(outTmp, os.Stdout, outOff)
+			errOff = tailFile(errTmp, os.Stderr, errOff)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	lockErr := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_SH)
+	close(stop)
+	wg.Wait()
+	if lockErr != nil {
+		return lockErr
+	}
+
+	state, err := backend.Get(key)
+	exitCode := 0
+	switch {
+	case err == nil:
+		exitCode = state.ExitCode
+		// The leader may have committed its last bytes to the backend
+		// between our final poll and the lock release; replay whatever our
+		// live tail missed.
+		catchUpBlob(backend, key, "out", os.Stdout, outOff)
+		catchUpBlob(backend, key, "err", os.Stderr, errOff)
+	case errors.Is(err, errEntryNotFound):
+		// The leader's run finished but wasn't committed (e.g. a failure
+		// without --cache-failures); its sidecar lock file is our only
+		// source for the exit code it relayed. If that file is missing, or
+		// never got an exit code written to it, the leader never finished
+		// the command at all (killed, OOM'd, crashed) and released the lock
+		// by dying rather than by completing — that's a real failure, not
+		// success.
+		info, lockErr := readLockFile(localLockInfoPath(dir, key))
+		if lockErr != nil {
+			return fmt.Errorf("leader for this command disappeared without finishing: %w", lockErr)
+		}
+		if info.ExitCode == nil {
+			return fmt.Errorf("leader for this command (pid %d) exited without finishing", info.PID)
+		}
+		exitCode = *info.ExitCode
+	default:
+		return err
+	}
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+	return nil
+}
+
+// catchUpBlob copies whatever of a committed blob lies past offset to w. The
+// committed blob is byte-identical to the local scratch file it was built
+// from, so skipping the bytes already live-tailed and copying the rest
+// reproduces exactly what a reader watching from the start would have seen.
+func catchUpBlob(backend Backend, key, fd string, w io.Writer, offset int64) {
+	f, err := backend.Open(key, fd)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, f, offset); err != nil {
+			return
+		}
+	}
+	io.Copy(w, f)
+}
+
+// tailFile copies any bytes written to path past offset to w, returning the
+// new offset. Errors (including the file not existing yet) are swallowed;
+// the caller just tries again on the next poll.
+func tailFile(path string, w io.Writer, offset int64) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.Size() <= offset {
+		return offset
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	n, _ := io.Copy(w, f)
+	return offset + n
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// TestFollowRunErrorsOnCrashedLeader covers the case where a leader dies
+// mid-run (killed, OOM'd) without ever writing an exit code: its lock file
+// is left behind with only a PID, and releasing its flock (by exiting) is
+// the only signal a follower gets. The follower must treat that as a
+// failure, not silently exit 0.
+func TestFollowRunErrorsOnCrashedLeader(t *testing.T) {
+	dir := t.TempDir()
+	key := "v2-test_crashed"
+
+	lockFile, err := openLockFile(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+
+	// Simulate a leader that started (wrote its PID) but crashed before
+	// recording a result, then had its flock released by process exit.
+	if err := writeLockFile(localLockInfoPath(dir, key), lockInfo{PID: 99999}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := newFilesystemBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := followRun(lockFile, backend, dir, key); err == nil {
+		t.Fatal("followRun: got nil error for a crashed leader, want a real error (not a silent exit 0)")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// chunk records a contiguous run of bytes written to one of the blob files,
+// in the order it was produced, so a replay can interleave stdout and
+// stderr the way the command originally produced them.
+type chunk struct {
+	FD  string `json:"fd"` // "out" or "err"
+	Len int64  `json:"len"`
+}
+
+// commandState is the metadata a Backend persists. The actual command
+// output lives in backend-managed blobs (see Backend.Open) so this struct
+// stays small regardless of how much output the command produced.
+type commandState struct {
+	Cmd        []string       `json:"cmd"`
+	Time       time.Time      `json:"time"`
+	ExitCode   int            `json:"exit_code"`
+	HasErr     bool           `json:"has_err,omitempty"`
+	Size       int64          `json:"size"`
+	SHA256     string         `json:"sha256,omitempty"`
+	Chunks     []chunk        `json:"chunks,omitempty"`
+	KeyVersion string         `json:"key_version,omitempty"`
+	KeyInputs  []keyComponent `json:"key_inputs,omitempty"`
+
+	key string // cache key this state was loaded or computed for; not persisted
+}
+
+func (s *commandState) IsExpired(ttl time.Duration) bool {
+	return time.Now().After(s.Time.Add(ttl))
+}
+
+// SetResult records a finished capture in the state, ready to be persisted.
+func (s *commandState) SetResult(r *captureResult) {
+	s.Time = time.Now()
+	s.Size = r.Size
+	s.SHA256 = r.SHA256
+	s.Chunks = r.Chunks
+	s.HasErr = r.HasStderr
+}
+
+// Replay writes the cached stdout and stderr to stdout/stderr respectively,
+// in the order they were originally produced, streaming from backend's
+// blobs rather than holding the output in memory.
+func (s *commandState) Replay(backend Backend, stdout, stderr io.Writer) error {
+	if len(s.Chunks) == 0 {
+		return nil
+	}
+	return replayChunks(backend, s.key, s.Chunks, stdout, stderr)
+}